@@ -0,0 +1,91 @@
+package queue
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// BackoffConfig tunes the per-key exponential backoff applied between
+// retries of the same queued key, in the style of
+// cenkalti/backoff/v4's ExponentialBackOff: a multiplicatively growing
+// interval, randomized by Jitter, capped at MaxInterval.
+type BackoffConfig struct {
+	InitialInterval time.Duration
+	Multiplier      float64
+	MaxInterval     time.Duration
+	// Jitter randomizes the computed interval by +/- this fraction, so
+	// that keys which started failing at the same time don't all retry
+	// in lockstep.
+	Jitter float64
+}
+
+// DefaultBackoffConfig caps a persistently unreachable key's retry
+// interval at 10 minutes so it doesn't hot-loop against the routing
+// layer, while still retrying promptly once it recovers.
+var DefaultBackoffConfig = BackoffConfig{
+	InitialInterval: 500 * time.Millisecond,
+	Multiplier:      1.5,
+	MaxInterval:     10 * time.Minute,
+	Jitter:          0.5,
+}
+
+type keyBackoff struct {
+	interval time.Duration
+	nextTry  time.Time
+}
+
+// Backoff applies BackoffConfig independently per key, so a single
+// persistently unreachable key doesn't throttle retries of every other
+// key sharing the same queue.
+type Backoff struct {
+	cfg BackoffConfig
+
+	mu    sync.Mutex
+	state map[string]*keyBackoff
+}
+
+// NewBackoff constructs a Backoff tracker using cfg.
+func NewBackoff(cfg BackoffConfig) *Backoff {
+	return &Backoff{cfg: cfg, state: make(map[string]*keyBackoff)}
+}
+
+// Ready reports whether key is due for a retry attempt.
+func (b *Backoff) Ready(key string) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.state[key]
+	return !ok || !time.Now().Before(st.nextTry)
+}
+
+// Failure records a failed attempt for key and advances its backoff.
+func (b *Backoff) Failure(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	st, ok := b.state[key]
+	if !ok {
+		st = &keyBackoff{interval: b.cfg.InitialInterval}
+		b.state[key] = st
+	} else {
+		st.interval = time.Duration(float64(st.interval) * b.cfg.Multiplier)
+		if st.interval > b.cfg.MaxInterval {
+			st.interval = b.cfg.MaxInterval
+		}
+	}
+
+	jitter := 1.0
+	if b.cfg.Jitter > 0 {
+		jitter += (rand.Float64()*2 - 1) * b.cfg.Jitter
+	}
+	st.nextTry = time.Now().Add(time.Duration(float64(st.interval) * jitter))
+}
+
+// Success clears key's backoff state, so its next failure starts again
+// from InitialInterval.
+func (b *Backoff) Success(key string) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.state, key)
+}
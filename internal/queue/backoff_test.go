@@ -0,0 +1,75 @@
+package queue
+
+import (
+	"testing"
+	"time"
+)
+
+func TestBackoffReadyAfterFailureThenSuccess(t *testing.T) {
+	cfg := BackoffConfig{
+		InitialInterval: 20 * time.Millisecond,
+		Multiplier:      2,
+		MaxInterval:     time.Second,
+		Jitter:          0,
+	}
+	b := NewBackoff(cfg)
+
+	if !b.Ready("k") {
+		t.Fatal("expected a fresh key to be ready immediately")
+	}
+
+	b.Failure("k")
+	if b.Ready("k") {
+		t.Fatal("expected key to not be ready right after a failure")
+	}
+
+	time.Sleep(cfg.InitialInterval + 10*time.Millisecond)
+	if !b.Ready("k") {
+		t.Fatal("expected key to become ready once its backoff interval elapses")
+	}
+
+	b.Success("k")
+	b.mu.Lock()
+	_, stillTracked := b.state["k"]
+	b.mu.Unlock()
+	if stillTracked {
+		t.Fatal("expected Success to clear the key's backoff state")
+	}
+}
+
+func TestBackoffFailureCapsAtMaxInterval(t *testing.T) {
+	cfg := BackoffConfig{
+		InitialInterval: 10 * time.Millisecond,
+		Multiplier:      2,
+		MaxInterval:     40 * time.Millisecond,
+		Jitter:          0,
+	}
+	b := NewBackoff(cfg)
+
+	for i := 0; i < 10; i++ {
+		b.Failure("k")
+	}
+
+	b.mu.Lock()
+	interval := b.state["k"].interval
+	b.mu.Unlock()
+
+	if interval != cfg.MaxInterval {
+		t.Fatalf("expected repeated failures to cap the interval at %v, got %v", cfg.MaxInterval, interval)
+	}
+}
+
+func TestBackoffIndependentPerKey(t *testing.T) {
+	cfg := BackoffConfig{
+		InitialInterval: 20 * time.Millisecond,
+		Multiplier:      2,
+		MaxInterval:     time.Second,
+		Jitter:          0,
+	}
+	b := NewBackoff(cfg)
+
+	b.Failure("stuck")
+	if !b.Ready("fresh") {
+		t.Fatal("a failure on one key should not throttle retries of an unrelated key")
+	}
+}
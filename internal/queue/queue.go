@@ -0,0 +1,244 @@
+// Package queue provides a datastore-backed FIFO of multihashes, used to
+// hold keys that still need to be (re)provided after a failed attempt or
+// while the node is offline.
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/multiformats/go-base32"
+	"github.com/multiformats/go-multihash"
+)
+
+var log = logging.Logger("dht/provqueue")
+
+const (
+	// entryPrefix namespaces the FIFO entries themselves. Each key ends
+	// in a zero-padded sequence number so a query ordered by key replays
+	// entries in enqueue order.
+	entryPrefix = "/provqueue/entry/"
+
+	// indexPrefix namespaces a secondary index from a multihash to its
+	// entry sequence number, used to deduplicate repeat enqueues.
+	indexPrefix = "/provqueue/index/"
+
+	seqDigits = 20 // enough for any uint64
+)
+
+// Queue is a persistent FIFO of multihashes. It is meant to share the
+// datastore backing a provider manager, so entries survive restarts
+// alongside the provider records they relate to. Concurrent Enqueue and
+// Dequeue calls are safe.
+type Queue struct {
+	dstore ds.Datastore
+
+	mu      sync.Mutex
+	nextSeq uint64
+}
+
+// New constructs a Queue backed by dstore, recovering nextSeq from any
+// entries already present (e.g. left over from a previous run).
+func New(ctx context.Context, dstore ds.Datastore) (*Queue, error) {
+	q := &Queue{dstore: dstore}
+
+	res, err := dstore.Query(ctx, dsq.Query{Prefix: entryPrefix, KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	for {
+		e, ok := res.NextSync()
+		if !ok {
+			break
+		}
+		if e.Error != nil {
+			log.Error("failed to list existing provide queue entries: ", e.Error)
+			continue
+		}
+		seq, err := seqFromEntryKey(e.Key)
+		if err != nil {
+			log.Error("malformed provide queue entry key: ", err)
+			continue
+		}
+		if seq >= q.nextSeq {
+			q.nextSeq = seq + 1
+		}
+	}
+
+	return q, nil
+}
+
+// Enqueue appends mh to the tail of the queue, unless it is already
+// queued.
+func (q *Queue) Enqueue(ctx context.Context, mh multihash.Multihash) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	idxKey := indexKey(mh)
+	if _, err := q.dstore.Get(ctx, idxKey); err == nil {
+		return nil // already queued
+	} else if err != ds.ErrNotFound {
+		return err
+	}
+
+	seq := q.nextSeq
+	q.nextSeq++
+
+	val := make([]byte, 8+len(mh))
+	binary.BigEndian.PutUint64(val[:8], uint64(time.Now().UnixNano()))
+	copy(val[8:], mh)
+
+	if err := q.dstore.Put(ctx, entryKey(seq), val); err != nil {
+		return err
+	}
+	return q.dstore.Put(ctx, idxKey, seqBytes(seq))
+}
+
+// Dequeue removes and returns the oldest queued multihash. It polls
+// until one is available or ctx is done.
+func (q *Queue) Dequeue(ctx context.Context) (multihash.Multihash, error) {
+	const pollInterval = time.Second
+
+	for {
+		mh, ok, err := q.tryDequeue(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if ok {
+			return mh, nil
+		}
+
+		select {
+		case <-time.After(pollInterval):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+func (q *Queue) tryDequeue(ctx context.Context) (multihash.Multihash, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	res, err := q.dstore.Query(ctx, dsq.Query{
+		Prefix: entryPrefix,
+		Orders: []dsq.Order{dsq.OrderByKey{}},
+		Limit:  1,
+	})
+	if err != nil {
+		return nil, false, err
+	}
+	defer res.Close()
+
+	e, ok := res.NextSync()
+	if !ok {
+		return nil, false, nil
+	}
+	if e.Error != nil {
+		return nil, false, e.Error
+	}
+	if len(e.Value) < 8 {
+		// shouldn't happen; drop the malformed entry rather than wedge
+		// the queue on it forever.
+		log.Error("dropping malformed provide queue entry: ", e.Key)
+		_ = q.dstore.Delete(ctx, ds.NewKey(e.Key))
+		return nil, false, nil
+	}
+
+	mh := multihash.Multihash(e.Value[8:])
+
+	if err := q.dstore.Delete(ctx, ds.NewKey(e.Key)); err != nil && err != ds.ErrNotFound {
+		return nil, false, err
+	}
+	if err := q.dstore.Delete(ctx, indexKey(mh)); err != nil && err != ds.ErrNotFound {
+		return nil, false, err
+	}
+
+	return mh, true, nil
+}
+
+// Len reports how many multihashes are currently queued.
+func (q *Queue) Len(ctx context.Context) (int, error) {
+	res, err := q.dstore.Query(ctx, dsq.Query{Prefix: entryPrefix, KeysOnly: true})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	n := 0
+	for {
+		_, ok := res.NextSync()
+		if !ok {
+			break
+		}
+		n++
+	}
+	return n, nil
+}
+
+// OldestAge reports how long the oldest queued entry has been waiting,
+// or zero if the queue is empty.
+func (q *Queue) OldestAge(ctx context.Context) (time.Duration, error) {
+	res, err := q.dstore.Query(ctx, dsq.Query{
+		Prefix: entryPrefix,
+		Orders: []dsq.Order{dsq.OrderByKey{}},
+		Limit:  1,
+	})
+	if err != nil {
+		return 0, err
+	}
+	defer res.Close()
+
+	e, ok := res.NextSync()
+	if !ok {
+		return 0, nil
+	}
+	if e.Error != nil {
+		return 0, e.Error
+	}
+	if len(e.Value) < 8 {
+		return 0, fmt.Errorf("malformed provide queue entry: %s", e.Key)
+	}
+
+	ns := int64(binary.BigEndian.Uint64(e.Value[:8]))
+	return time.Since(time.Unix(0, ns)), nil
+}
+
+// Close releases any resources held by the queue. The underlying
+// datastore's lifecycle belongs to the caller; Close exists for symmetry
+// with the rest of this module's datastore-backed types.
+func (q *Queue) Close() error {
+	return nil
+}
+
+func entryKey(seq uint64) ds.Key {
+	return ds.NewKey(entryPrefix + fmt.Sprintf("%0*d", seqDigits, seq))
+}
+
+func seqFromEntryKey(dsk string) (uint64, error) {
+	name := strings.TrimPrefix(dsk, entryPrefix)
+	if name == dsk {
+		return 0, fmt.Errorf("malformed provide queue entry key: %s", dsk)
+	}
+	return strconv.ParseUint(name, 10, 64)
+}
+
+func indexKey(mh multihash.Multihash) ds.Key {
+	return ds.NewKey(indexPrefix + base32.RawStdEncoding.EncodeToString(mh))
+}
+
+func seqBytes(seq uint64) []byte {
+	buf := make([]byte, 8)
+	binary.BigEndian.PutUint64(buf, seq)
+	return buf
+}
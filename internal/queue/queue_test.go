@@ -0,0 +1,150 @@
+package queue
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	"github.com/multiformats/go-multihash"
+)
+
+func testMH(t *testing.T, s string) multihash.Multihash {
+	t.Helper()
+	mh, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mh
+}
+
+func TestQueueFIFOOrder(t *testing.T) {
+	ctx := context.Background()
+	q, err := New(ctx, ds.NewMapDatastore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	want := []multihash.Multihash{testMH(t, "a"), testMH(t, "b"), testMH(t, "c")}
+	for _, mh := range want {
+		if err := q.Enqueue(ctx, mh); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	for i, w := range want {
+		got, err := q.Dequeue(ctx)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Equal(got, w) {
+			t.Fatalf("entry %d: got %x, want %x", i, got, w)
+		}
+	}
+}
+
+func TestQueueDedupesEnqueue(t *testing.T) {
+	ctx := context.Background()
+	q, err := New(ctx, ds.NewMapDatastore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	mh := testMH(t, "dup")
+	if err := q.Enqueue(ctx, mh); err != nil {
+		t.Fatal(err)
+	}
+	if err := q.Enqueue(ctx, mh); err != nil {
+		t.Fatal(err)
+	}
+
+	n, err := q.Len(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Fatalf("expected a repeat enqueue to be deduped, queue length is %d", n)
+	}
+
+	got, err := q.Dequeue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, mh) {
+		t.Fatalf("got %x, want %x", got, mh)
+	}
+
+	// Having been dequeued, the key is no longer indexed as queued, so
+	// re-enqueueing it should succeed rather than being treated as a dup.
+	if err := q.Enqueue(ctx, mh); err != nil {
+		t.Fatal(err)
+	}
+	if n, err := q.Len(ctx); err != nil || n != 1 {
+		t.Fatalf("expected re-enqueue after dequeue to succeed, len=%d err=%v", n, err)
+	}
+}
+
+func TestQueueDequeueBlocksUntilContextDone(t *testing.T) {
+	ctx := context.Background()
+	q, err := New(ctx, ds.NewMapDatastore())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q.Close()
+
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+
+	if _, err := q.Dequeue(timeoutCtx); err == nil {
+		t.Fatal("expected Dequeue to return an error once ctx is done on an empty queue")
+	}
+}
+
+func TestQueueSurvivesRestart(t *testing.T) {
+	dstore := ds.NewMapDatastore()
+	ctx := context.Background()
+
+	q1, err := New(ctx, dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	first := testMH(t, "first")
+	if err := q1.Enqueue(ctx, first); err != nil {
+		t.Fatal(err)
+	}
+	if err := q1.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Simulate a process restart: a fresh Queue opened over the same
+	// datastore must recover nextSeq so new entries sort after old ones.
+	q2, err := New(ctx, dstore)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer q2.Close()
+
+	second := testMH(t, "second")
+	if err := q2.Enqueue(ctx, second); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := q2.Dequeue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, first) {
+		t.Fatalf("expected the pre-restart entry to come out first: got %x, want %x", got, first)
+	}
+
+	got, err = q2.Dequeue(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, second) {
+		t.Fatalf("got %x, want %x", got, second)
+	}
+}
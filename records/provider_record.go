@@ -0,0 +1,130 @@
+package records
+
+import (
+	"encoding/binary"
+	"fmt"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+// maxPersistedProviderAddrs bounds how many multiaddrs get written into a
+// single provider record, so a peer that has accumulated a long address
+// history doesn't blow up record size.
+const maxPersistedProviderAddrs = 16
+
+// Provider records are either:
+//   - legacy (version 0): a bare binary.PutVarint-encoded UnixNano
+//     timestamp, with no magic byte. Every such record's first byte has
+//     its continuation bit set, since a realistic timestamp always spans
+//     more than one varint byte.
+//   - versioned (version >= 1): recordMagic, followed by a version byte,
+//     followed by a version-specific payload. recordMagic's high bit is
+//     unset, which a legacy record's first byte can never be, so the two
+//     formats are unambiguous on read.
+const (
+	recordMagic byte = 0x01
+	recordV1    byte = 0x01
+)
+
+// encodeProviderRecord writes t and addrs in the version 1 format:
+// recordMagic, recordV1, varint(t.UnixNano()), uvarint(len(addrs)), then
+// each address as uvarint(len) followed by its raw multiaddr bytes.
+func encodeProviderRecord(t time.Time, addrs []multiaddr.Multiaddr) []byte {
+	buf := make([]byte, 2, 2+binary.MaxVarintLen64*(2+len(addrs)))
+	buf[0] = recordMagic
+	buf[1] = recordV1
+
+	var varintBuf [binary.MaxVarintLen64]byte
+
+	n := binary.PutVarint(varintBuf[:], t.UnixNano())
+	buf = append(buf, varintBuf[:n]...)
+
+	n = binary.PutUvarint(varintBuf[:], uint64(len(addrs)))
+	buf = append(buf, varintBuf[:n]...)
+
+	for _, a := range addrs {
+		ab := a.Bytes()
+		n = binary.PutUvarint(varintBuf[:], uint64(len(ab)))
+		buf = append(buf, varintBuf[:n]...)
+		buf = append(buf, ab...)
+	}
+
+	return buf
+}
+
+// decodeProviderRecord parses a provider record written by either
+// writeProviderEntry (legacy) or encodeProviderRecord (versioned),
+// returning the stored timestamp and, for versioned records, the stored
+// addresses.
+func decodeProviderRecord(data []byte) (time.Time, []multiaddr.Multiaddr, error) {
+	if len(data) >= 2 && data[0] == recordMagic {
+		switch data[1] {
+		case recordV1:
+			return decodeProviderRecordV1(data[2:])
+		default:
+			return time.Time{}, nil, fmt.Errorf("unsupported provider record version: %d", data[1])
+		}
+	}
+
+	nsec, n := binary.Varint(data)
+	if n <= 0 {
+		return time.Time{}, nil, fmt.Errorf("failed to parse provider record")
+	}
+	return time.Unix(0, nsec), nil, nil
+}
+
+func decodeProviderRecordV1(data []byte) (time.Time, []multiaddr.Multiaddr, error) {
+	nsec, n := binary.Varint(data)
+	if n <= 0 {
+		return time.Time{}, nil, fmt.Errorf("failed to parse provider record timestamp")
+	}
+	data = data[n:]
+
+	count, n := binary.Uvarint(data)
+	if n <= 0 {
+		return time.Time{}, nil, fmt.Errorf("failed to parse provider record address count")
+	}
+	data = data[n:]
+
+	addrs := make([]multiaddr.Multiaddr, 0, count)
+	for i := uint64(0); i < count; i++ {
+		l, n := binary.Uvarint(data)
+		if n <= 0 || uint64(len(data)-n) < l {
+			return time.Time{}, nil, fmt.Errorf("failed to parse provider record address")
+		}
+		data = data[n:]
+
+		a, err := multiaddr.NewMultiaddrBytes(data[:l])
+		if err != nil {
+			return time.Time{}, nil, fmt.Errorf("failed to parse provider record address: %w", err)
+		}
+		addrs = append(addrs, a)
+		data = data[l:]
+	}
+
+	return time.Unix(0, nsec), addrs, nil
+}
+
+// dedupeAddrs returns up to max unique addresses from addrs, preserving
+// order.
+func dedupeAddrs(addrs []multiaddr.Multiaddr, max int) []multiaddr.Multiaddr {
+	if len(addrs) == 0 {
+		return nil
+	}
+
+	seen := make(map[string]struct{}, len(addrs))
+	out := make([]multiaddr.Multiaddr, 0, len(addrs))
+	for _, a := range addrs {
+		s := a.String()
+		if _, ok := seen[s]; ok {
+			continue
+		}
+		seen[s] = struct{}{}
+		out = append(out, a)
+		if len(out) >= max {
+			break
+		}
+	}
+	return out
+}
@@ -0,0 +1,87 @@
+package records
+
+import (
+	"encoding/binary"
+	"testing"
+	"time"
+
+	"github.com/multiformats/go-multiaddr"
+)
+
+func TestDecodeProviderRecordLegacy(t *testing.T) {
+	want := time.Unix(0, 1234567890)
+
+	buf := make([]byte, binary.MaxVarintLen64)
+	n := binary.PutVarint(buf, want.UnixNano())
+
+	got, addrs, err := decodeProviderRecord(buf[:n])
+	if err != nil {
+		t.Fatalf("decodeProviderRecord: %v", err)
+	}
+	if !got.Equal(want) {
+		t.Fatalf("timestamp mismatch: got %v, want %v", got, want)
+	}
+	if len(addrs) != 0 {
+		t.Fatalf("expected no addrs from a legacy record, got %v", addrs)
+	}
+}
+
+func TestEncodeDecodeProviderRecordV1RoundTrip(t *testing.T) {
+	want := time.Unix(0, 1700000000123456789)
+	a1, err := multiaddr.NewMultiaddr("/ip4/127.0.0.1/tcp/4001")
+	if err != nil {
+		t.Fatal(err)
+	}
+	a2, err := multiaddr.NewMultiaddr("/ip4/1.2.3.4/udp/4001/quic-v1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	wantAddrs := []multiaddr.Multiaddr{a1, a2}
+
+	data := encodeProviderRecord(want, wantAddrs)
+	if data[0] != recordMagic || data[1] != recordV1 {
+		t.Fatalf("expected versioned record header, got %v", data[:2])
+	}
+
+	gotTime, gotAddrs, err := decodeProviderRecord(data)
+	if err != nil {
+		t.Fatalf("decodeProviderRecord: %v", err)
+	}
+	if !gotTime.Equal(want) {
+		t.Fatalf("timestamp mismatch: got %v, want %v", gotTime, want)
+	}
+	if len(gotAddrs) != len(wantAddrs) {
+		t.Fatalf("addr count mismatch: got %d, want %d", len(gotAddrs), len(wantAddrs))
+	}
+	for i, a := range wantAddrs {
+		if !gotAddrs[i].Equal(a) {
+			t.Fatalf("addr %d mismatch: got %s, want %s", i, gotAddrs[i], a)
+		}
+	}
+}
+
+func TestEncodeProviderRecordNoAddrs(t *testing.T) {
+	// writeProviderEntry only calls encodeProviderRecord when addrs is
+	// non-empty, but decodeProviderRecord must still handle a versioned
+	// record with zero addresses correctly.
+	want := time.Unix(0, 42)
+	data := encodeProviderRecord(want, nil)
+
+	gotTime, gotAddrs, err := decodeProviderRecord(data)
+	if err != nil {
+		t.Fatalf("decodeProviderRecord: %v", err)
+	}
+	if !gotTime.Equal(want) {
+		t.Fatalf("timestamp mismatch: got %v, want %v", gotTime, want)
+	}
+	if len(gotAddrs) != 0 {
+		t.Fatalf("expected no addrs, got %v", gotAddrs)
+	}
+}
+
+func TestDecodeProviderRecordUnsupportedVersion(t *testing.T) {
+	_, _, err := decodeProviderRecord([]byte{recordMagic, 0xff})
+	if err == nil {
+		t.Fatal("expected an error for an unsupported record version")
+	}
+}
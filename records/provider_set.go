@@ -0,0 +1,44 @@
+package records
+
+import (
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+)
+
+// providerSet is an in-memory index of the providers known for a single
+// key, used to populate and update the LRU cache without re-querying the
+// datastore on every lookup.
+type providerSet struct {
+	providers []peer.ID
+	set       map[peer.ID]time.Time
+}
+
+func newProviderSet() *providerSet {
+	return &providerSet{
+		set: make(map[peer.ID]time.Time),
+	}
+}
+
+// setVal records (or refreshes) the last-seen time for p.
+func (ps *providerSet) setVal(p peer.ID, t time.Time) {
+	if _, found := ps.set[p]; !found {
+		ps.providers = append(ps.providers, p)
+	}
+	ps.set[p] = t
+}
+
+// removeVal drops p from the set, reporting whether it was present.
+func (ps *providerSet) removeVal(p peer.ID) bool {
+	if _, found := ps.set[p]; !found {
+		return false
+	}
+	delete(ps.set, p)
+	for i, cur := range ps.providers {
+		if cur == p {
+			ps.providers = append(ps.providers[:i], ps.providers[i+1:]...)
+			break
+		}
+	}
+	return true
+}
@@ -3,13 +3,14 @@ package records
 import (
 	"context"
 	"encoding/binary"
-	"errors"
 	"fmt"
 	"io"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
 
+	"github.com/cespare/xxhash/v2"
 	lru "github.com/hashicorp/golang-lru/simplelru"
 	ds "github.com/ipfs/go-datastore"
 	"github.com/ipfs/go-datastore/autobatch"
@@ -21,6 +22,7 @@ import (
 	"github.com/libp2p/go-libp2p/core/peerstore"
 	peerstoreImpl "github.com/libp2p/go-libp2p/p2p/host/peerstore"
 	"github.com/multiformats/go-base32"
+	"github.com/multiformats/go-multiaddr"
 )
 
 const (
@@ -43,35 +45,70 @@ var (
 	lruCacheSize           = 256
 	batchBufferSize        = 256
 	log                    = logging.Logger("providers")
+
+	// defaultOrphanCheckInterval is how often the orphaned-record sweep
+	// runs. It is independent of cleanupInterval since it walks the
+	// peerstore rather than just the cache/datastore.
+	defaultOrphanCheckInterval = time.Hour
+
+	// defaultOrphanGraceMultiplier sets the default orphan grace period,
+	// expressed as a multiple of ProviderAddrTTL, so a peer only gets
+	// swept once its addresses would have expired from the peerstore
+	// several times over.
+	defaultOrphanGraceMultiplier = 3
 )
 
 // ProviderStore represents a store that associates peers and their addresses to keys.
 type ProviderStore interface {
 	AddProvider(ctx context.Context, key []byte, prov peer.AddrInfo) error
 	GetProviders(ctx context.Context, key []byte) ([]peer.AddrInfo, error)
+	RemoveProvider(ctx context.Context, key []byte, p peer.ID) error
+	RemoveProviderByPeer(ctx context.Context, p peer.ID) error
 	io.Closer
 }
 
-// ProviderManager adds and pulls providers out of the datastore,
-// caching them in between
+// ProviderManager adds and pulls providers out of the datastore, caching
+// them in between. Work is partitioned across a fixed number of shards,
+// each with its own actor goroutine, cache and GC/orphan-sweep timers, so
+// that a single hot key (or a burst of unrelated provide traffic) can't
+// serialize every caller behind one channel. A key always maps to the
+// same shard, so callers still observe read-your-writes ordering for
+// that key.
 type ProviderManager struct {
-	self peer.ID
-	// all non channel fields are meant to be accessed only within
-	// the run method
-	cache  lru.LRUCache
+	self   peer.ID
 	pstore peerstore.Peerstore
-	dstore *autobatch.Datastore
 
-	newprovs chan *addProv
-	getprovs chan *getProv
+	shards []*pmShard
 
 	cleanupInterval time.Duration
 
+	orphanCheckInterval time.Duration
+	orphanGracePeriod   time.Duration
+	orphanPredicate     OrphanPredicate
+
+	persistProviderAddrs bool
+
 	ctx    context.Context
 	cancel context.CancelFunc
 	wg     sync.WaitGroup
 }
 
+// pmShard owns one partition of the keyspace: its own cache, its own
+// autobatch writer over the shared underlying datastore, and its own
+// channels, so its actor goroutine never blocks on another shard's work.
+// All non-channel fields are meant to be accessed only from within the
+// shard's own run goroutine.
+type pmShard struct {
+	idx    int
+	cache  lru.LRUCache
+	dstore *autobatch.Datastore
+
+	newprovs      chan *addProv
+	getprovs      chan *getProv
+	rmprovs       chan *rmProv
+	rmprovsByPeer chan *rmProvByPeer
+}
+
 var _ ProviderStore = (*ProviderManager)(nil)
 
 // Option is a function that sets a provider manager option.
@@ -95,11 +132,78 @@ func CleanupInterval(d time.Duration) Option {
 	}
 }
 
-// Cache sets the LRU cache implementation.
-// Defaults to a simple LRU cache.
-func Cache(c lru.LRUCache) Option {
+// OrphanPredicate decides whether the records held for p should be
+// considered orphaned and removed during the orphan sweep.
+type OrphanPredicate func(p peer.ID, ps peerstore.Peerstore) bool
+
+// defaultOrphanPredicate considers a peer orphaned once the peerstore no
+// longer holds any addresses for it.
+func defaultOrphanPredicate(p peer.ID, ps peerstore.Peerstore) bool {
+	return len(ps.Addrs(p)) == 0
+}
+
+// OrphanCheckInterval sets the time between orphaned-record sweeps.
+// Defaults to 1h.
+func OrphanCheckInterval(d time.Duration) Option {
+	return func(pm *ProviderManager) error {
+		pm.orphanCheckInterval = d
+		return nil
+	}
+}
+
+// OrphanGracePeriod sets how long a record must have gone unrefreshed
+// before it is eligible for the orphan sweep, on top of satisfying
+// OrphanPredicate. Defaults to ProviderAddrTTL * 3.
+func OrphanGracePeriod(d time.Duration) Option {
 	return func(pm *ProviderManager) error {
-		pm.cache = c
+		pm.orphanGracePeriod = d
+		return nil
+	}
+}
+
+// WithOrphanPredicate overrides the default OrphanPredicate.
+func WithOrphanPredicate(f OrphanPredicate) Option {
+	return func(pm *ProviderManager) error {
+		pm.orphanPredicate = f
+		return nil
+	}
+}
+
+// PersistProviderAddrs opts in to persisting a provider's peerstore
+// addresses alongside its timestamp, so GetProviders can return a
+// reachable peer.AddrInfo right after a restart without an extra DHT
+// lookup. Off by default, in which case records keep the legacy
+// bare-timestamp on-disk format.
+func PersistProviderAddrs(persist bool) Option {
+	return func(pm *ProviderManager) error {
+		pm.persistProviderAddrs = persist
+		return nil
+	}
+}
+
+// ShardCount sets the number of independent shards the ProviderManager
+// partitions its keyspace across. Defaults to runtime.GOMAXPROCS(0).
+func ShardCount(n int) Option {
+	return func(pm *ProviderManager) error {
+		if n < 1 {
+			return fmt.Errorf("shard count must be at least 1, got %d", n)
+		}
+		pm.shards = make([]*pmShard, n)
+		return nil
+	}
+}
+
+// newShardCache builds each shard's LRU cache. Defaults to a simple LRU
+// cache of size lruCacheSize.
+var newShardCache = func() (lru.LRUCache, error) {
+	return lru.NewLRU(lruCacheSize, nil)
+}
+
+// Cache overrides the constructor used for each shard's LRU cache.
+// Defaults to a simple LRU cache of size 256.
+func Cache(newCache func() (lru.LRUCache, error)) Option {
+	return func(pm *ProviderManager) error {
+		newShardCache = newCache
 		return nil
 	}
 }
@@ -116,129 +220,280 @@ type getProv struct {
 	resp chan []peer.ID
 }
 
+type rmProv struct {
+	ctx  context.Context
+	key  []byte
+	val  peer.ID
+	resp chan error
+}
+
+type rmProvByPeer struct {
+	ctx  context.Context
+	val  peer.ID
+	resp chan error
+}
+
 // NewProviderManager constructor
 func NewProviderManager(ctx context.Context, local peer.ID, ps peerstore.Peerstore, dstore ds.Batching, opts ...Option) (*ProviderManager, error) {
 	pm := new(ProviderManager)
 	pm.self = local
-	pm.getprovs = make(chan *getProv)
-	pm.newprovs = make(chan *addProv)
 	pm.pstore = ps
-	pm.dstore = autobatch.NewAutoBatching(dstore, batchBufferSize)
-	cache, err := lru.NewLRU(lruCacheSize, nil)
-	if err != nil {
-		return nil, err
-	}
-	pm.cache = cache
 	pm.cleanupInterval = defaultCleanupInterval
+	pm.orphanCheckInterval = defaultOrphanCheckInterval
+	pm.orphanGracePeriod = ProviderAddrTTL * time.Duration(defaultOrphanGraceMultiplier)
+	pm.orphanPredicate = defaultOrphanPredicate
 	if err := pm.applyOptions(opts...); err != nil {
 		return nil, err
 	}
+
+	if pm.shards == nil {
+		pm.shards = make([]*pmShard, runtime.GOMAXPROCS(0))
+	}
+	for i := range pm.shards {
+		cache, err := newShardCache()
+		if err != nil {
+			return nil, err
+		}
+		pm.shards[i] = &pmShard{
+			idx:           i,
+			cache:         cache,
+			dstore:        autobatch.NewAutoBatching(dstore, batchBufferSize),
+			getprovs:      make(chan *getProv),
+			newprovs:      make(chan *addProv),
+			rmprovs:       make(chan *rmProv),
+			rmprovsByPeer: make(chan *rmProvByPeer),
+		}
+	}
+
 	pm.ctx, pm.cancel = context.WithCancel(ctx)
 	pm.run()
 	return pm, nil
 }
 
+// shardFor returns the shard that owns k. The same key always maps to
+// the same shard, so a caller that adds a provider and then looks it up
+// always observes its own write.
+func (pm *ProviderManager) shardFor(k []byte) *pmShard {
+	h := xxhash.Sum64(k)
+	return pm.shards[h%uint64(len(pm.shards))]
+}
+
 func (pm *ProviderManager) run() {
-	pm.wg.Add(1)
-	go func() {
-		defer pm.wg.Done()
+	for _, shard := range pm.shards {
+		pm.wg.Add(1)
+		go pm.runShard(shard)
+	}
+}
+
+// runShard is the actor loop for a single shard. GC and orphan-sweep
+// timers are staggered across shards (by a fraction of their interval
+// proportional to the shard index) so that all shards don't purge their
+// caches and kick off datastore scans in the same instant.
+func (pm *ProviderManager) runShard(shard *pmShard) {
+	defer pm.wg.Done()
 
-		var gcQuery dsq.Results
-		gcTimer := time.NewTimer(pm.cleanupInterval)
+	stagger := func(interval time.Duration) time.Duration {
+		if len(pm.shards) <= 1 || interval <= 0 {
+			return interval
+		}
+		return interval + interval*time.Duration(shard.idx)/time.Duration(len(pm.shards))
+	}
+
+	var gcQuery dsq.Results
+	gcTimer := time.NewTimer(stagger(pm.cleanupInterval))
 
-		defer func() {
-			gcTimer.Stop()
-			if gcQuery != nil {
+	var orphanQuery dsq.Results
+	orphanTimer := time.NewTimer(stagger(pm.orphanCheckInterval))
+
+	defer func() {
+		gcTimer.Stop()
+		if gcQuery != nil {
+			gcQuery.Close()
+		}
+		orphanTimer.Stop()
+		if orphanQuery != nil {
+			orphanQuery.Close()
+		}
+		if err := shard.dstore.Flush(context.Background()); err != nil {
+			log.Error("failed to flush datastore: ", err)
+		}
+	}()
+
+	var gcQueryRes <-chan dsq.Result
+	var gcSkip map[string]struct{}
+	var gcTime time.Time
+
+	var orphanQueryRes <-chan dsq.Result
+	for {
+		select {
+		case np := <-shard.newprovs:
+			err := pm.addProv(shard, np.ctx, np.key, np.val)
+			if err != nil {
+				log.Error("error adding new providers: ", err)
+				continue
+			}
+			if gcSkip != nil {
+				// we have an gc, tell it to skip this provider
+				// as we've updated it since the GC started.
+				gcSkip[mkProvKeyFor(np.key, np.val)] = struct{}{}
+			}
+		case gp := <-shard.getprovs:
+			provs, err := pm.getProvidersForKey(shard, gp.ctx, gp.key)
+			if err != nil && err != ds.ErrNotFound {
+				log.Error("error reading providers: ", err)
+			}
+
+			// set the cap so the user can't append to this.
+			gp.resp <- provs[0:len(provs):len(provs)]
+		case rp := <-shard.rmprovs:
+			err := pm.removeProvider(shard, rp.ctx, rp.key, rp.val)
+			if err == nil && gcSkip != nil {
+				// tell the in-flight GC round to leave this entry
+				// alone; we've just deleted it ourselves.
+				gcSkip[mkProvKeyFor(rp.key, rp.val)] = struct{}{}
+			}
+			rp.resp <- err
+		case rp := <-shard.rmprovsByPeer:
+			rp.resp <- pm.removeProviderByPeer(shard, rp.ctx, rp.val, gcSkip)
+		case res, ok := <-gcQueryRes:
+			if !ok {
 				gcQuery.Close()
+				gcTimer.Reset(pm.cleanupInterval)
+
+				// cleanup GC round
+				gcQueryRes = nil
+				gcSkip = nil
+				gcQuery = nil
+				continue
 			}
-			if err := pm.dstore.Flush(context.Background()); err != nil {
-				log.Error("failed to flush datastore: ", err)
+			if res.Error != nil {
+				log.Error("got error from GC query: ", res.Error)
+				continue
 			}
-		}()
-
-		var gcQueryRes <-chan dsq.Result
-		var gcSkip map[string]struct{}
-		var gcTime time.Time
-		for {
-			select {
-			case np := <-pm.newprovs:
-				err := pm.addProv(np.ctx, np.key, np.val)
-				if err != nil {
-					log.Error("error adding new providers: ", err)
-					continue
-				}
-				if gcSkip != nil {
-					// we have an gc, tell it to skip this provider
-					// as we've updated it since the GC started.
-					gcSkip[mkProvKeyFor(np.key, np.val)] = struct{}{}
-				}
-			case gp := <-pm.getprovs:
-				provs, err := pm.getProvidersForKey(gp.ctx, gp.key)
+			if k, err := keyFromProvKey(res.Key); err == nil && pm.shardFor(k) != shard {
+				// Owned by a different shard; that shard's own GC
+				// round will act on it. The query walks the full
+				// namespace (the on-disk layout has no shard
+				// segment to prefix-scan by), so every shard sees
+				// every record but only acts on the ones it owns.
+				continue
+			}
+			if _, ok := gcSkip[res.Key]; ok {
+				// We've updated this record since starting the
+				// GC round, skip it.
+				continue
+			}
+
+			// check expiration time
+			t, err := readTimeValue(res.Value)
+			switch {
+			case err != nil:
+				// couldn't parse the time
+				log.Error("parsing providers record from disk: ", err)
+				fallthrough
+			case gcTime.Sub(t) > ProvideValidity:
+				// or expired
+				err = shard.dstore.Delete(pm.ctx, ds.RawKey(res.Key))
 				if err != nil && err != ds.ErrNotFound {
-					log.Error("error reading providers: ", err)
+					log.Error("failed to remove provider record from disk: ", err)
 				}
+			}
 
-				// set the cap so the user can't append to this.
-				gp.resp <- provs[0:len(provs):len(provs)]
-			case res, ok := <-gcQueryRes:
-				if !ok {
-					gcQuery.Close()
-					gcTimer.Reset(pm.cleanupInterval)
-
-					// cleanup GC round
-					gcQueryRes = nil
-					gcSkip = nil
-					gcQuery = nil
-					continue
-				}
-				if res.Error != nil {
-					log.Error("got error from GC query: ", res.Error)
-					continue
-				}
-				if _, ok := gcSkip[res.Key]; ok {
-					// We've updated this record since starting the
-					// GC round, skip it.
-					continue
-				}
+		case gcTime = <-gcTimer.C:
+			// You know the wonderful thing about caches? You can
+			// drop them.
+			//
+			// Much faster than GCing.
+			shard.cache.Purge()
+
+			// Kick off a GC of the datastore. The shard segment
+			// isn't part of the on-disk key, so this walks the
+			// full shared namespace; the gcQueryRes case above
+			// filters to the records this shard owns.
+			q, err := shard.dstore.Query(pm.ctx, dsq.Query{
+				Prefix: ProvidersKeyPrefix,
+			})
+			if err != nil {
+				log.Error("provider record GC query failed: ", err)
+				continue
+			}
+			gcQuery = q
+			gcQueryRes = q.Next()
+			gcSkip = make(map[string]struct{})
+		case res, ok := <-orphanQueryRes:
+			if !ok {
+				orphanQuery.Close()
+				orphanTimer.Reset(pm.orphanCheckInterval)
+
+				orphanQueryRes = nil
+				orphanQuery = nil
+				continue
+			}
+			if res.Error != nil {
+				log.Error("got error from orphan sweep query: ", res.Error)
+				continue
+			}
+			k, err := keyFromProvKey(res.Key)
+			if err != nil {
+				// the TTL GC round already handles unparsable
+				// records; nothing more for the orphan sweep to do.
+				continue
+			}
+			if pm.shardFor(k) != shard {
+				// Owned by a different shard; see the GC query's
+				// gcQueryRes case for why this walks the full
+				// namespace instead of a shard-scoped prefix.
+				continue
+			}
+			if _, ok := gcSkip[res.Key]; ok {
+				// touched since the in-flight GC round started, leave
+				// it alone; with no GC round in flight gcSkip is nil
+				// and nothing is skipped here.
+				continue
+			}
 
-				// check expiration time
-				t, err := readTimeValue(res.Value)
-				switch {
-				case err != nil:
-					// couldn't parse the time
-					log.Error("parsing providers record from disk: ", err)
-					fallthrough
-				case gcTime.Sub(t) > ProvideValidity:
-					// or expired
-					err = pm.dstore.Delete(pm.ctx, ds.RawKey(res.Key))
-					if err != nil && err != ds.ErrNotFound {
-						log.Error("failed to remove provider record from disk: ", err)
-					}
-				}
+			t, err := readTimeValue(res.Value)
+			if err != nil {
+				// the TTL GC round already handles unparsable
+				// records; nothing more for the orphan sweep to do.
+				continue
+			}
+			if time.Since(t) <= pm.orphanGracePeriod {
+				continue
+			}
 
-			case gcTime = <-gcTimer.C:
-				// You know the wonderful thing about caches? You can
-				// drop them.
-				//
-				// Much faster than GCing.
-				pm.cache.Purge()
-
-				// Now, kick off a GC of the datastore.
-				q, err := pm.dstore.Query(pm.ctx, dsq.Query{
-					Prefix: ProvidersKeyPrefix,
-				})
-				if err != nil {
-					log.Error("provider record GC query failed: ", err)
-					continue
-				}
-				gcQuery = q
-				gcQueryRes = q.Next()
-				gcSkip = make(map[string]struct{})
-			case <-pm.ctx.Done():
-				return
+			p, err := peerFromProvKey(res.Key)
+			if err != nil {
+				log.Error("failed to parse peer from provider key: ", err)
+				continue
+			}
+			if !pm.orphanPredicate(p, pm.pstore) {
+				continue
+			}
+
+			if err := shard.dstore.Delete(pm.ctx, ds.RawKey(res.Key)); err != nil && err != ds.ErrNotFound {
+				log.Error("failed to remove orphaned provider record from disk: ", err)
+				continue
+			}
+			if cached, ok := shard.cache.Get(string(k)); ok {
+				cached.(*providerSet).removeVal(p)
 			}
+			log.Infof("removed orphaned provider record for peer %s", p)
+		case <-orphanTimer.C:
+			// Full namespace; see the GC query above.
+			q, err := shard.dstore.Query(pm.ctx, dsq.Query{
+				Prefix: ProvidersKeyPrefix,
+			})
+			if err != nil {
+				log.Error("orphan sweep query failed: ", err)
+				continue
+			}
+			orphanQuery = q
+			orphanQueryRes = q.Next()
+		case <-pm.ctx.Done():
+			return
 		}
-	}()
+	}
 }
 
 func (pm *ProviderManager) Close() error {
@@ -260,8 +515,9 @@ func (pm *ProviderManager) AddProvider(ctx context.Context, k []byte, provInfo p
 		key: k,
 		val: provInfo.ID,
 	}
+	shard := pm.shardFor(k)
 	select {
-	case pm.newprovs <- prov:
+	case shard.newprovs <- prov:
 		return nil
 	case <-ctx.Done():
 		return ctx.Err()
@@ -269,25 +525,190 @@ func (pm *ProviderManager) AddProvider(ctx context.Context, k []byte, provInfo p
 }
 
 // addProv updates the cache if needed
-func (pm *ProviderManager) addProv(ctx context.Context, k []byte, p peer.ID) error {
+func (pm *ProviderManager) addProv(shard *pmShard, ctx context.Context, k []byte, p peer.ID) error {
 	now := time.Now()
-	if provs, ok := pm.cache.Get(string(k)); ok {
+	if provs, ok := shard.cache.Get(string(k)); ok {
 		provs.(*providerSet).setVal(p, now)
 	} // else not cached, just write through
 
-	return writeProviderEntry(ctx, pm.dstore, k, p, now)
+	var addrs []multiaddr.Multiaddr
+	if pm.persistProviderAddrs {
+		addrs = dedupeAddrs(pm.pstore.Addrs(p), maxPersistedProviderAddrs)
+	}
+
+	return writeProviderEntry(ctx, shard.dstore, k, p, now, addrs)
 }
 
-// writeProviderEntry writes the provider into the datastore
-func writeProviderEntry(ctx context.Context, dstore ds.Datastore, k []byte, p peer.ID, t time.Time) error {
+// writeProviderEntry writes the provider into the datastore. When addrs
+// is non-empty the record is written in the versioned format (see
+// encodeProviderRecord); otherwise it keeps the legacy bare-varint-
+// timestamp format so PersistProviderAddrs(false) (the default) leaves
+// the on-disk format unchanged.
+func writeProviderEntry(ctx context.Context, dstore ds.Datastore, k []byte, p peer.ID, t time.Time, addrs []multiaddr.Multiaddr) error {
 	dsk := mkProvKeyFor(k, p)
 
-	buf := make([]byte, 16)
-	n := binary.PutVarint(buf, t.UnixNano())
+	if len(addrs) == 0 {
+		buf := make([]byte, 16)
+		n := binary.PutVarint(buf, t.UnixNano())
+		return dstore.Put(ctx, ds.NewKey(dsk), buf[:n])
+	}
 
-	return dstore.Put(ctx, ds.NewKey(dsk), buf[:n])
+	return dstore.Put(ctx, ds.NewKey(dsk), encodeProviderRecord(t, addrs))
 }
 
+// RemoveProvider removes the association between key and p, e.g. because
+// p is known to no longer provide it. It is a no-op if no such
+// association exists.
+func (pm *ProviderManager) RemoveProvider(ctx context.Context, key []byte, p peer.ID) error {
+	ctx, span := internal.StartSpan(ctx, "ProviderManager.RemoveProvider")
+	defer span.End()
+
+	rm := &rmProv{
+		ctx:  ctx,
+		key:  key,
+		val:  p,
+		resp: make(chan error, 1),
+	}
+	shard := pm.shardFor(key)
+	select {
+	case shard.rmprovs <- rm:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-rm.resp:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// removeProvider patches the cache, if present, and deletes the record
+// from disk.
+func (pm *ProviderManager) removeProvider(shard *pmShard, ctx context.Context, k []byte, p peer.ID) error {
+	if cached, ok := shard.cache.Get(string(k)); ok {
+		cached.(*providerSet).removeVal(p)
+	}
+
+	err := shard.dstore.Delete(ctx, ds.RawKey(mkProvKeyFor(k, p)))
+	if err != nil && err != ds.ErrNotFound {
+		return err
+	}
+	return nil
+}
+
+// RemoveProviderByPeer removes every provider record for p, e.g. because
+// p has left the network or been demoted. Since p's records may live on
+// any shard (they're keyed by content key first, not by peer), this asks
+// every shard to walk the shared ProvidersKeyPrefix namespace and remove
+// the records it owns.
+func (pm *ProviderManager) RemoveProviderByPeer(ctx context.Context, p peer.ID) error {
+	ctx, span := internal.StartSpan(ctx, "ProviderManager.RemoveProviderByPeer")
+	defer span.End()
+
+	type pending struct {
+		shard *pmShard
+		rm    *rmProvByPeer
+	}
+	inflight := make([]pending, 0, len(pm.shards))
+	for _, shard := range pm.shards {
+		rm := &rmProvByPeer{
+			ctx:  ctx,
+			val:  p,
+			resp: make(chan error, 1),
+		}
+		select {
+		case shard.rmprovsByPeer <- rm:
+			inflight = append(inflight, pending{shard: shard, rm: rm})
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+
+	var firstErr error
+	for _, pend := range inflight {
+		select {
+		case err := <-pend.rm.resp:
+			if err != nil && firstErr == nil {
+				firstErr = err
+			}
+		case <-ctx.Done():
+			if firstErr == nil {
+				firstErr = ctx.Err()
+			}
+		}
+	}
+	return firstErr
+}
+
+// removeProviderByPeer walks the full provider namespace (the on-disk
+// layout has no shard segment to scope the query by) for every entry
+// belonging to p, patching the cache and deleting the record on disk
+// for each one this shard owns. Entries owned by another shard are
+// left for that shard to act on, so a record is only ever deleted
+// once. gcSkip, if a GC round is in flight on this shard, is updated
+// so that round doesn't try to act on keys this call has just removed.
+func (pm *ProviderManager) removeProviderByPeer(shard *pmShard, ctx context.Context, p peer.ID, gcSkip map[string]struct{}) error {
+	suffix := "/" + base32.RawStdEncoding.EncodeToString([]byte(p))
+
+	res, err := shard.dstore.Query(ctx, dsq.Query{Prefix: ProvidersKeyPrefix, KeysOnly: true})
+	if err != nil {
+		return err
+	}
+	defer res.Close()
+
+	var firstErr error
+	for {
+		e, ok := res.NextSync()
+		if !ok {
+			break
+		}
+		if e.Error != nil {
+			log.Error("got an error walking provider records: ", e.Error)
+			continue
+		}
+		if !strings.HasSuffix(e.Key, suffix) {
+			continue
+		}
+
+		decKey, err := keyFromProvKey(e.Key)
+		if err != nil {
+			log.Error("base32 decoding error: ", err)
+			continue
+		}
+		if pm.shardFor(decKey) != shard {
+			// Another shard owns this key and will act on it
+			// from its own copy of this query.
+			continue
+		}
+		if cached, ok := shard.cache.Get(string(decKey)); ok {
+			cached.(*providerSet).removeVal(p)
+		}
+
+		if err := shard.dstore.Delete(ctx, ds.RawKey(e.Key)); err != nil && err != ds.ErrNotFound {
+			log.Error("failed to remove provider record from disk: ", err)
+			firstErr = err
+			continue
+		}
+
+		if gcSkip != nil {
+			// only tell the in-flight GC round to skip this key once
+			// we know it's actually gone; a failed delete leaves it on
+			// disk and still eligible for GC to reap.
+			gcSkip[e.Key] = struct{}{}
+		}
+	}
+	return firstErr
+}
+
+// mkProvKeyFor/mkProvKey/keyFromProvKey/peerFromProvKey deliberately do
+// not encode the shard index: which shard owns a key is a routing/cache
+// decision recomputed from the key via shardFor, not part of the
+// on-disk layout. Baking the shard index into the key would make every
+// existing record unreadable the moment the shard count (which defaults
+// to runtime.GOMAXPROCS and can legitimately change across restarts)
+// changed, and would require a migration for records written before
+// sharding existed at all.
 func mkProvKeyFor(k []byte, p peer.ID) string {
 	return mkProvKey(k) + "/" + base32.RawStdEncoding.EncodeToString([]byte(p))
 }
@@ -296,6 +717,31 @@ func mkProvKey(k []byte) string {
 	return ProvidersKeyPrefix + base32.RawStdEncoding.EncodeToString(k)
 }
 
+// keyFromProvKey recovers the raw content key from a full provider
+// record datastore key, as produced by mkProvKeyFor.
+func keyFromProvKey(dsk string) ([]byte, error) {
+	mid := strings.TrimPrefix(dsk, ProvidersKeyPrefix)
+	lix := strings.LastIndex(mid, "/")
+	if lix < 0 {
+		return nil, fmt.Errorf("malformed provider record key: %s", dsk)
+	}
+	return base32.RawStdEncoding.DecodeString(mid[:lix])
+}
+
+// peerFromProvKey recovers the peer ID from a full provider record
+// datastore key, as produced by mkProvKeyFor.
+func peerFromProvKey(dsk string) (peer.ID, error) {
+	lix := strings.LastIndex(dsk, "/")
+	if lix < 0 {
+		return "", fmt.Errorf("malformed provider record key: %s", dsk)
+	}
+	decstr, err := base32.RawStdEncoding.DecodeString(dsk[lix+1:])
+	if err != nil {
+		return "", err
+	}
+	return peer.ID(decstr), nil
+}
+
 // GetProviders returns the set of providers for the given key.
 // This method _does not_ copy the set. Do not modify it.
 func (pm *ProviderManager) GetProviders(ctx context.Context, k []byte) ([]peer.AddrInfo, error) {
@@ -307,10 +753,11 @@ func (pm *ProviderManager) GetProviders(ctx context.Context, k []byte) ([]peer.A
 		key:  k,
 		resp: make(chan []peer.ID, 1), // buffered to prevent sender from blocking
 	}
+	shard := pm.shardFor(k)
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
-	case pm.getprovs <- gp:
+	case shard.getprovs <- gp:
 	}
 	select {
 	case <-ctx.Done():
@@ -320,8 +767,8 @@ func (pm *ProviderManager) GetProviders(ctx context.Context, k []byte) ([]peer.A
 	}
 }
 
-func (pm *ProviderManager) getProvidersForKey(ctx context.Context, k []byte) ([]peer.ID, error) {
-	pset, err := pm.getProviderSetForKey(ctx, k)
+func (pm *ProviderManager) getProvidersForKey(shard *pmShard, ctx context.Context, k []byte) ([]peer.ID, error) {
+	pset, err := pm.getProviderSetForKey(shard, ctx, k)
 	if err != nil {
 		return nil, err
 	}
@@ -329,26 +776,29 @@ func (pm *ProviderManager) getProvidersForKey(ctx context.Context, k []byte) ([]
 }
 
 // returns the ProviderSet if it already exists on cache, otherwise loads it from datasatore
-func (pm *ProviderManager) getProviderSetForKey(ctx context.Context, k []byte) (*providerSet, error) {
-	cached, ok := pm.cache.Get(string(k))
+func (pm *ProviderManager) getProviderSetForKey(shard *pmShard, ctx context.Context, k []byte) (*providerSet, error) {
+	cached, ok := shard.cache.Get(string(k))
 	if ok {
 		return cached.(*providerSet), nil
 	}
 
-	pset, err := loadProviderSet(ctx, pm.dstore, k)
+	pset, err := loadProviderSet(ctx, shard.dstore, k, pm.pstore, pm.persistProviderAddrs)
 	if err != nil {
 		return nil, err
 	}
 
 	if len(pset.providers) > 0 {
-		pm.cache.Add(string(k), pset)
+		shard.cache.Add(string(k), pset)
 	}
 
 	return pset, nil
 }
 
-// loads the ProviderSet out of the datastore
-func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*providerSet, error) {
+// loads the ProviderSet out of the datastore. When persistAddrs is set,
+// any multiaddrs stored alongside a record (see encodeProviderRecord)
+// are fed back into ps so a restart doesn't require an extra DHT lookup
+// to reach the provider.
+func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte, ps peerstore.Peerstore, persistAddrs bool) (*providerSet, error) {
 	res, err := dstore.Query(ctx, dsq.Query{Prefix: mkProvKey(k)})
 	if err != nil {
 		return nil, err
@@ -368,10 +818,10 @@ func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*provi
 		}
 
 		// check expiration time
-		t, err := readTimeValue(e.Value)
+		t, addrs, err := decodeProviderRecord(e.Value)
 		switch {
 		case err != nil:
-			// couldn't parse the time
+			// couldn't parse the record
 			log.Error("parsing providers record from disk: ", err)
 			fallthrough
 		case now.Sub(t) > ProvideValidity:
@@ -397,17 +847,19 @@ func loadProviderSet(ctx context.Context, dstore ds.Datastore, k []byte) (*provi
 
 		pid := peer.ID(decstr)
 
+		if persistAddrs && len(addrs) > 0 {
+			ps.AddAddrs(pid, addrs, ProviderAddrTTL)
+		}
+
 		out.setVal(pid, t)
 	}
 
 	return out, nil
 }
 
+// readTimeValue reads just the timestamp out of a provider record,
+// legacy or versioned.
 func readTimeValue(data []byte) (time.Time, error) {
-	nsec, n := binary.Varint(data)
-	if n <= 0 {
-		return time.Time{}, errors.New("failed to parse time")
-	}
-
-	return time.Unix(0, nsec), nil
+	t, _, err := decodeProviderRecord(data)
+	return t, err
 }
@@ -0,0 +1,73 @@
+package records
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/peerstore"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestProviderManagerOrphanSweepRemovesPastGracePeriod(t *testing.T) {
+	alwaysOrphaned := func(peer.ID, peerstore.Peerstore) bool { return true }
+	pm := newTestProviderManager(t,
+		ShardCount(1),
+		OrphanCheckInterval(10*time.Millisecond),
+		OrphanGracePeriod(time.Millisecond),
+		WithOrphanPredicate(alwaysOrphaned),
+	)
+	ctx := context.Background()
+
+	key := []byte("orphan-key")
+	p := test.RandPeerIDFatal(t)
+	if err := pm.AddProvider(ctx, key, peer.AddrInfo{ID: p}); err != nil {
+		t.Fatal(err)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		provs, err := pm.GetProviders(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(provs) == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("orphaned provider record for %s was not swept in time", p)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}
+
+func TestProviderManagerOrphanSweepRespectsGracePeriod(t *testing.T) {
+	alwaysOrphaned := func(peer.ID, peerstore.Peerstore) bool { return true }
+	pm := newTestProviderManager(t,
+		ShardCount(1),
+		OrphanCheckInterval(10*time.Millisecond),
+		OrphanGracePeriod(time.Hour),
+		WithOrphanPredicate(alwaysOrphaned),
+	)
+	ctx := context.Background()
+
+	key := []byte("not-orphan-key")
+	p := test.RandPeerIDFatal(t)
+	if err := pm.AddProvider(ctx, key, peer.AddrInfo{ID: p}); err != nil {
+		t.Fatal(err)
+	}
+
+	// Let a few sweep cycles run; the record is within its grace period
+	// (set to an hour) so OrphanPredicate being satisfied shouldn't matter
+	// yet.
+	time.Sleep(50 * time.Millisecond)
+
+	provs, err := pm.GetProviders(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provs) != 1 || provs[0].ID != p {
+		t.Fatalf("expected provider to survive within its grace period, got %v", provs)
+	}
+}
@@ -0,0 +1,76 @@
+package records
+
+import (
+	"context"
+	"testing"
+
+	"github.com/libp2p/go-libp2p/core/peer"
+	"github.com/libp2p/go-libp2p/core/test"
+)
+
+func TestProviderManagerRemoveProvider(t *testing.T) {
+	pm := newTestProviderManager(t, ShardCount(1))
+	ctx := context.Background()
+
+	key := []byte("a-key")
+	p1 := test.RandPeerIDFatal(t)
+	p2 := test.RandPeerIDFatal(t)
+
+	if err := pm.AddProvider(ctx, key, peer.AddrInfo{ID: p1}); err != nil {
+		t.Fatal(err)
+	}
+	if err := pm.AddProvider(ctx, key, peer.AddrInfo{ID: p2}); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := pm.RemoveProvider(ctx, key, p1); err != nil {
+		t.Fatal(err)
+	}
+
+	provs, err := pm.GetProviders(ctx, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(provs) != 1 || provs[0].ID != p2 {
+		t.Fatalf("expected only %s left, got %v", p2, provs)
+	}
+
+	// removing it again is a no-op, not an error.
+	if err := pm.RemoveProvider(ctx, key, p1); err != nil {
+		t.Fatalf("expected no error removing an already-removed provider, got %v", err)
+	}
+}
+
+func TestProviderManagerRemoveProviderByPeer(t *testing.T) {
+	pm := newTestProviderManager(t, ShardCount(4))
+	ctx := context.Background()
+
+	victim := test.RandPeerIDFatal(t)
+	bystander := test.RandPeerIDFatal(t)
+
+	var keys [][]byte
+	for i := 0; i < 20; i++ {
+		key := []byte{byte(i)}
+		keys = append(keys, key)
+		if err := pm.AddProvider(ctx, key, peer.AddrInfo{ID: victim}); err != nil {
+			t.Fatal(err)
+		}
+		if err := pm.AddProvider(ctx, key, peer.AddrInfo{ID: bystander}); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := pm.RemoveProviderByPeer(ctx, victim); err != nil {
+		t.Fatal(err)
+	}
+
+	for _, key := range keys {
+		provs, err := pm.GetProviders(ctx, key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(provs) != 1 || provs[0].ID != bystander {
+			t.Fatalf("key %s: expected only %s left, got %v", key, bystander, provs)
+		}
+	}
+}
@@ -0,0 +1,508 @@
+package records
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/ipfs/go-cid"
+	ds "github.com/ipfs/go-datastore"
+	dsq "github.com/ipfs/go-datastore/query"
+	logging "github.com/ipfs/go-log/v2"
+	"github.com/libp2p/go-libp2p-kad-dht/internal/queue"
+	"github.com/multiformats/go-base32"
+	"github.com/multiformats/go-multihash"
+)
+
+var reproviderLog = logging.Logger("reprovider")
+
+const (
+	// ReprovideKeyPrefix is the prefix/namespace under which the persistent
+	// reprovide queue is stored in the provider manager's datastore.
+	ReprovideKeyPrefix = "/reprovide/queue/"
+
+	// defaultReprovideInterval is kept comfortably under ProvideValidity
+	// (24h) so that keys get re-announced before their records expire on
+	// remote peers.
+	defaultReprovideInterval = 22 * time.Hour
+
+	// defaultInitialReprovideDelay staggers the first reprovide after
+	// construction so a freshly started node isn't immediately hammered
+	// with a full reprovide sweep before it has many peers.
+	defaultInitialReprovideDelay = time.Minute
+)
+
+// Strategy selects which set of keys a Reprovider re-announces on each
+// sweep. The DHT itself has no notion of pins or DAG roots; KeyProvider
+// is how callers plug that knowledge in. The Reprovider itself only
+// records Strategy in ReproviderStats; the default key provider lists
+// every queued key whatever the Strategy, so StrategyPinned and
+// StrategyRoots take effect only through a KeyProvider supplied with
+// WithKeyProvider.
+type Strategy int
+
+const (
+	// StrategyAll reprovides every key queued via Reprovider.Provide and
+	// not since removed with Reprovider.Stop.
+	StrategyAll Strategy = iota
+	// StrategyPinned reprovides only keys a caller-supplied KeyProvider
+	// reports as pinned.
+	StrategyPinned
+	// StrategyRoots reprovides only root keys a caller-supplied
+	// KeyProvider reports.
+	StrategyRoots
+)
+
+// KeyProvider supplies the set of keys that should be (re)provided on a
+// given sweep. The default, queue-backed implementation is used unless
+// the caller supplies one via WithKeyProvider.
+type KeyProvider func(ctx context.Context) ([]multihash.Multihash, error)
+
+// ProvideMany is implemented by routing clients that can announce many
+// keys in a single call. When the Reprovider's routing implementation
+// satisfies this interface, it is preferred over repeated calls to
+// Provide.
+type ProvideMany interface {
+	ProvideMany(ctx context.Context, keys []multihash.Multihash) error
+}
+
+// ContentRouting is the minimal routing capability the Reprovider needs
+// when its routing implementation does not support ProvideMany.
+type ContentRouting interface {
+	Provide(ctx context.Context, key cid.Cid, announce bool) error
+}
+
+// ThroughputCallback is invoked after every batch a Reprovider announces.
+// Returning false tells the Reprovider to abandon the in-progress sweep,
+// which is useful for backing off when the routing layer is under load.
+type ThroughputCallback func(complete uint, duration time.Duration) (continueReproviding bool)
+
+// ReproviderStats reports the outcome of the most recently completed
+// reprovide sweep, plus the current state of the retry queue holding
+// keys whose last announce attempt failed.
+type ReproviderStats struct {
+	Strategy       Strategy
+	LastRun        time.Time
+	LastDuration   time.Duration
+	KeysReprovided uint
+	LastErr        error
+
+	RetryQueueDepth     int
+	RetryQueueOldestAge time.Duration
+}
+
+// ReprovideOption configures a Reprovider.
+type ReprovideOption func(*Reprovider) error
+
+// ReprovideInterval sets the time between reprovide sweeps. Defaults to
+// 22h, comfortably under ProvideValidity.
+func ReprovideInterval(d time.Duration) ReprovideOption {
+	return func(r *Reprovider) error {
+		r.interval = d
+		return nil
+	}
+}
+
+// InitialReprovideDelay sets how long the Reprovider waits after
+// construction before running its first sweep.
+func InitialReprovideDelay(d time.Duration) ReprovideOption {
+	return func(r *Reprovider) error {
+		r.initialDelay = d
+		return nil
+	}
+}
+
+// ReprovideStrategy selects which keys get reannounced. See Strategy.
+func ReprovideStrategy(s Strategy) ReprovideOption {
+	return func(r *Reprovider) error {
+		r.strategy = s
+		return nil
+	}
+}
+
+// WithThroughputCallback registers a callback invoked after every batch.
+func WithThroughputCallback(cb ThroughputCallback) ReprovideOption {
+	return func(r *Reprovider) error {
+		r.throughput = cb
+		return nil
+	}
+}
+
+// WithKeyProvider overrides the default queue-backed KeyProvider, e.g. to
+// implement StrategyPinned/StrategyRoots in terms of an external pinner.
+func WithKeyProvider(kp KeyProvider) ReprovideOption {
+	return func(r *Reprovider) error {
+		r.keyProvider = kp
+		return nil
+	}
+}
+
+// ReprovideBatchSize caps how many keys are handed to a single
+// ProvideMany call.
+func ReprovideBatchSize(n int) ReprovideOption {
+	return func(r *Reprovider) error {
+		if n < 1 {
+			return fmt.Errorf("reprovide batch size must be at least 1, got %d", n)
+		}
+		r.batchSize = n
+		return nil
+	}
+}
+
+// WithBackoffConfig overrides the exponential backoff applied to keys
+// that fail to announce, before they're retried from the persistent
+// retry queue. Defaults to queue.DefaultBackoffConfig.
+func WithBackoffConfig(cfg queue.BackoffConfig) ReprovideOption {
+	return func(r *Reprovider) error {
+		r.backoffConfig = cfg
+		return nil
+	}
+}
+
+// Reprovider maintains a persistent queue of keys this node provides and
+// periodically re-announces them to the routing layer, batching via
+// ProvideMany when possible. It is the counterpart, on the announcing
+// side, to ProviderManager's storage of records received from others. A
+// second persistent queue holds keys whose last announce attempt failed,
+// retried by a dedicated worker with per-key exponential backoff so an
+// unreachable peer set doesn't hot-loop the routing layer.
+type Reprovider struct {
+	dstore ds.Datastore
+	many   ProvideMany
+	router ContentRouting
+
+	interval     time.Duration
+	initialDelay time.Duration
+	strategy     Strategy
+	batchSize    int
+	throughput   ThroughputCallback
+	keyProvider  KeyProvider
+
+	backoffConfig queue.BackoffConfig
+	retryQueue    *queue.Queue
+	retryBackoff  *queue.Backoff
+
+	triggerReprovide chan struct{}
+
+	mu    sync.Mutex
+	stats ReproviderStats
+
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+}
+
+const defaultReprovideBatchSize = 256
+
+// NewReprovider constructs a Reprovider that persists its queue in
+// dstore (typically the same datastore backing a ProviderManager) and
+// announces keys via routing. routing must implement ProvideMany or
+// ContentRouting (or both); ProvideMany is preferred when available.
+func NewReprovider(ctx context.Context, dstore ds.Datastore, routing interface{}, opts ...ReprovideOption) (*Reprovider, error) {
+	r := &Reprovider{
+		dstore:           dstore,
+		interval:         defaultReprovideInterval,
+		initialDelay:     defaultInitialReprovideDelay,
+		batchSize:        defaultReprovideBatchSize,
+		backoffConfig:    queue.DefaultBackoffConfig,
+		triggerReprovide: make(chan struct{}, 1),
+	}
+
+	if many, ok := routing.(ProvideMany); ok {
+		r.many = many
+	}
+	if cr, ok := routing.(ContentRouting); ok {
+		r.router = cr
+	}
+	if r.many == nil && r.router == nil {
+		return nil, fmt.Errorf("reprovider: routing must implement ProvideMany or ContentRouting")
+	}
+
+	for i, opt := range opts {
+		if err := opt(r); err != nil {
+			return nil, fmt.Errorf("reprovider option %d failed: %s", i, err)
+		}
+	}
+	if r.keyProvider == nil {
+		r.keyProvider = r.queueKeyProvider
+	}
+
+	retryQueue, err := queue.New(ctx, dstore)
+	if err != nil {
+		return nil, fmt.Errorf("reprovider: failed to open retry queue: %w", err)
+	}
+	r.retryQueue = retryQueue
+	r.retryBackoff = queue.NewBackoff(r.backoffConfig)
+
+	r.ctx, r.cancel = context.WithCancel(ctx)
+	r.wg.Add(2)
+	go r.run()
+	go r.retryWorker()
+	return r, nil
+}
+
+// Provide enqueues key for (re)providing and, unless immediate is false,
+// also makes an initial provide call right away so callers don't have to
+// wait for the next sweep.
+func (r *Reprovider) Provide(ctx context.Context, key multihash.Multihash, immediate bool) error {
+	if err := r.dstore.Put(ctx, reprovideKey(key), []byte{}); err != nil {
+		return fmt.Errorf("reprovider: failed to persist queue entry: %w", err)
+	}
+	if !immediate {
+		return nil
+	}
+	if err := r.announce(ctx, []multihash.Multihash{key}); err != nil {
+		r.enqueueRetry([]multihash.Multihash{key})
+		return err
+	}
+	return nil
+}
+
+// Stop removes key from the reprovide queue; it will no longer be
+// re-announced on future sweeps.
+func (r *Reprovider) Stop(ctx context.Context, key multihash.Multihash) error {
+	if err := r.dstore.Delete(ctx, reprovideKey(key)); err != nil && err != ds.ErrNotFound {
+		return fmt.Errorf("reprovider: failed to remove queue entry: %w", err)
+	}
+	return nil
+}
+
+// Trigger requests an out-of-band reprovide sweep as soon as possible,
+// without waiting for the configured interval to elapse.
+func (r *Reprovider) Trigger() {
+	select {
+	case r.triggerReprovide <- struct{}{}:
+	default:
+	}
+}
+
+// Stats returns a snapshot of the most recently completed sweep, along
+// with the live depth and oldest-entry age of the retry queue.
+func (r *Reprovider) Stats() ReproviderStats {
+	r.mu.Lock()
+	stats := r.stats
+	r.mu.Unlock()
+
+	if depth, err := r.retryQueue.Len(r.ctx); err == nil {
+		stats.RetryQueueDepth = depth
+	} else {
+		reproviderLog.Error("failed to read retry queue depth: ", err)
+	}
+	if age, err := r.retryQueue.OldestAge(r.ctx); err == nil {
+		stats.RetryQueueOldestAge = age
+	} else {
+		reproviderLog.Error("failed to read retry queue oldest age: ", err)
+	}
+
+	return stats
+}
+
+// Close stops the background reprovide and retry loops.
+func (r *Reprovider) Close() error {
+	r.cancel()
+	r.wg.Wait()
+	return nil
+}
+
+func (r *Reprovider) run() {
+	defer r.wg.Done()
+
+	initialTimer := time.NewTimer(r.initialDelay)
+	defer initialTimer.Stop()
+
+	select {
+	case <-initialTimer.C:
+	case <-r.triggerReprovide:
+	case <-r.ctx.Done():
+		return
+	}
+
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+
+	for {
+		r.reprovide()
+
+		select {
+		case <-ticker.C:
+		case <-r.triggerReprovide:
+		case <-r.ctx.Done():
+			return
+		}
+	}
+}
+
+func (r *Reprovider) reprovide() {
+	start := time.Now()
+	keys, err := r.keyProvider(r.ctx)
+	if err != nil {
+		reproviderLog.Error("failed to list keys to reprovide: ", err)
+		r.recordStats(0, start, err)
+		return
+	}
+
+	var complete uint
+	for i := 0; i < len(keys); i += r.batchSize {
+		end := i + r.batchSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		batch := keys[i:end]
+
+		batchStart := time.Now()
+		if err := r.announce(r.ctx, batch); err != nil {
+			reproviderLog.Error("failed to reprovide batch: ", err)
+			if r.many != nil {
+				r.enqueueRetry(batch)
+			}
+		} else {
+			complete += uint(len(batch))
+		}
+
+		if r.throughput != nil && !r.throughput(complete, time.Since(batchStart)) {
+			break
+		}
+		if r.ctx.Err() != nil {
+			break
+		}
+	}
+
+	r.recordStats(complete, start, nil)
+}
+
+// announce hands keys to the routing layer, batching via ProvideMany
+// when available. It has no way to tell which keys in a batch failed
+// when ProvideMany returns an error, so in that case it reports the
+// whole batch as failed; the ContentRouting fallback path, which
+// announces one key at a time, reports exactly the keys that failed.
+func (r *Reprovider) announce(ctx context.Context, keys []multihash.Multihash) error {
+	if r.many != nil {
+		return r.many.ProvideMany(ctx, keys)
+	}
+	var firstErr error
+	for _, mh := range keys {
+		c := cid.NewCidV1(cid.Raw, mh)
+		if err := r.router.Provide(ctx, c, true); err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			r.enqueueRetry([]multihash.Multihash{mh})
+		}
+	}
+	return firstErr
+}
+
+// enqueueRetry persists keys onto the retry queue so the retry worker
+// picks them up with backoff applied. Call sites that use the
+// ProvideMany path call this with the whole failed batch, since a single
+// error from ProvideMany doesn't identify which keys failed; the
+// ContentRouting path (inside announce) calls it per failed key.
+func (r *Reprovider) enqueueRetry(keys []multihash.Multihash) {
+	for _, mh := range keys {
+		if err := r.retryQueue.Enqueue(r.ctx, mh); err != nil {
+			reproviderLog.Error("failed to enqueue provide retry: ", err)
+		}
+	}
+}
+
+// retryWorker drains the retry queue, honoring each key's backoff
+// schedule, and re-announces it through the routing layer.
+func (r *Reprovider) retryWorker() {
+	defer r.wg.Done()
+
+	for {
+		mh, err := r.retryQueue.Dequeue(r.ctx)
+		if err != nil {
+			return // ctx done
+		}
+
+		key := string(mh)
+		if !r.retryBackoff.Ready(key) {
+			// not due yet; put it back and pace ourselves so we don't
+			// spin immediately re-dequeuing the same entry.
+			r.enqueueRetry([]multihash.Multihash{mh})
+			select {
+			case <-time.After(time.Second):
+			case <-r.ctx.Done():
+				return
+			}
+			continue
+		}
+
+		if err := r.announceOne(r.ctx, mh); err != nil {
+			reproviderLog.Error("provide retry failed: ", err)
+			r.retryBackoff.Failure(key)
+			r.enqueueRetry([]multihash.Multihash{mh})
+			continue
+		}
+		r.retryBackoff.Success(key)
+	}
+}
+
+func (r *Reprovider) announceOne(ctx context.Context, mh multihash.Multihash) error {
+	if r.many != nil {
+		return r.many.ProvideMany(ctx, []multihash.Multihash{mh})
+	}
+	return r.router.Provide(ctx, cid.NewCidV1(cid.Raw, mh), true)
+}
+
+func (r *Reprovider) recordStats(complete uint, start time.Time, err error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	r.stats = ReproviderStats{
+		Strategy:       r.strategy,
+		LastRun:        start,
+		LastDuration:   time.Since(start),
+		KeysReprovided: complete,
+		LastErr:        err,
+	}
+}
+
+// queueKeyProvider is the default KeyProvider: it lists every key
+// persisted via Provide, regardless of Strategy (StrategyPinned/
+// StrategyRoots require a caller-supplied KeyProvider since this module
+// has no notion of pins or DAG roots).
+func (r *Reprovider) queueKeyProvider(ctx context.Context) ([]multihash.Multihash, error) {
+	res, err := r.dstore.Query(ctx, dsq.Query{Prefix: ReprovideKeyPrefix, KeysOnly: true})
+	if err != nil {
+		return nil, err
+	}
+	defer res.Close()
+
+	var keys []multihash.Multihash
+	for {
+		e, ok := res.NextSync()
+		if !ok {
+			break
+		}
+		if e.Error != nil {
+			reproviderLog.Error("reprovide queue query error: ", e.Error)
+			continue
+		}
+		mh, err := decodeReprovideKey(e.Key)
+		if err != nil {
+			reproviderLog.Error("failed to decode reprovide queue entry: ", err)
+			continue
+		}
+		keys = append(keys, mh)
+	}
+	return keys, nil
+}
+
+func reprovideKey(mh multihash.Multihash) ds.Key {
+	return ds.NewKey(ReprovideKeyPrefix + base32.RawStdEncoding.EncodeToString(mh))
+}
+
+func decodeReprovideKey(k string) (multihash.Multihash, error) {
+	name := strings.TrimPrefix(k, ReprovideKeyPrefix)
+	if name == k {
+		return nil, fmt.Errorf("malformed reprovide queue key: %s", k)
+	}
+	decoded, err := base32.RawStdEncoding.DecodeString(name)
+	if err != nil {
+		return nil, err
+	}
+	return multihash.Multihash(decoded), nil
+}
@@ -0,0 +1,102 @@
+package records
+
+import (
+	"context"
+	"sync"
+	"testing"
+	"time"
+
+	ds "github.com/ipfs/go-datastore"
+	dssync "github.com/ipfs/go-datastore/sync"
+	"github.com/multiformats/go-multihash"
+)
+
+// fakeProvideMany is a minimal ProvideMany implementation that records
+// every batch it was asked to announce.
+type fakeProvideMany struct {
+	mu    sync.Mutex
+	calls [][]multihash.Multihash
+}
+
+func (f *fakeProvideMany) ProvideMany(ctx context.Context, keys []multihash.Multihash) error {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	f.calls = append(f.calls, append([]multihash.Multihash(nil), keys...))
+	return nil
+}
+
+func (f *fakeProvideMany) callCount() int {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return len(f.calls)
+}
+
+func testMultihash(t *testing.T, s string) multihash.Multihash {
+	t.Helper()
+	mh, err := multihash.Sum([]byte(s), multihash.SHA2_256, -1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return mh
+}
+
+func TestReprovideBatchSizeRejectsNonPositive(t *testing.T) {
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	fake := &fakeProvideMany{}
+
+	_, err := NewReprovider(context.Background(), dstore, fake, ReprovideBatchSize(0))
+	if err == nil {
+		t.Fatal("expected an error constructing a Reprovider with a zero batch size")
+	}
+}
+
+func TestReproviderProvideAnnouncesImmediately(t *testing.T) {
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	fake := &fakeProvideMany{}
+
+	r, err := NewReprovider(context.Background(), dstore, fake,
+		InitialReprovideDelay(time.Hour), ReprovideInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	key := testMultihash(t, "hello")
+	if err := r.Provide(context.Background(), key, true); err != nil {
+		t.Fatal(err)
+	}
+	if fake.callCount() != 1 {
+		t.Fatalf("expected one immediate announce call, got %d", fake.callCount())
+	}
+}
+
+func TestReproviderTriggerRunsSweepAndUpdatesStats(t *testing.T) {
+	dstore := dssync.MutexWrap(ds.NewMapDatastore())
+	fake := &fakeProvideMany{}
+
+	r, err := NewReprovider(context.Background(), dstore, fake,
+		InitialReprovideDelay(time.Hour), ReprovideInterval(time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer r.Close()
+
+	key := testMultihash(t, "world")
+	if err := r.Provide(context.Background(), key, false); err != nil {
+		t.Fatal(err)
+	}
+
+	r.Trigger()
+
+	deadline := time.Now().Add(2 * time.Second)
+	for {
+		stats := r.Stats()
+		if stats.KeysReprovided == 1 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("sweep did not complete in time, last stats: %+v", stats)
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+}